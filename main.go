@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2015-2021 Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/russross/blackfriday/v2"
+)
+
+func newRenderer(format, filename, desc string, cols, tabs, flags int) (Renderer, error) {
+	switch format {
+	case "", "vimhelp":
+		return VimDocRenderer(filename, desc, cols, tabs, flags), nil
+	case "org":
+		return OrgDocRenderer(filename, desc, cols, tabs, flags), nil
+	case "plain":
+		return PlainDocRenderer(filename, desc, cols, tabs, flags), nil
+	default:
+		return nil, fmt.Errorf("unknown -format %q (want vimhelp, org, or plain)", format)
+	}
+}
+
+func readInput(args []string) ([]byte, string, error) {
+	if len(args) == 0 {
+		input, err := ioutil.ReadAll(os.Stdin)
+		return input, "stdin", err
+	}
+
+	input, err := ioutil.ReadFile(args[0])
+	return input, args[0], err
+}
+
+func main() {
+	desc := flag.String("desc", "", "description shown next to the file name in the header")
+	cols := flag.Int("cols", defNumCols, "column width to wrap output to")
+	tabs := flag.Int("tabs", defTabSize, "number of spaces used for indentation")
+	format := flag.String("format", "vimhelp", "output format: vimhelp, org, or plain")
+	noToc := flag.Bool("no-toc", false, "omit the generated table of contents (vimhelp only)")
+	noRules := flag.Bool("no-rules", false, "omit horizontal rules around headings")
+	pascal := flag.Bool("pascal", false, "use PascalCase help tags instead of lower_snake_case (vimhelp only)")
+	conceal := flag.Bool("conceal", false, "keep Markdown delimiters for conceal-based syntax highlighting (vimhelp only)")
+	flag.Parse()
+
+	input, filename, err := readInput(flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var flags int
+	if *noToc {
+		flags |= flagNoToc
+	}
+	if *noRules {
+		flags |= flagNoRules
+	}
+	if *pascal {
+		flags |= flagPascal
+	}
+	if *conceal {
+		flags |= flagConceal
+	}
+
+	renderer, err := newRenderer(*format, filename, *desc, *cols, *tabs, flags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	output := blackfriday.Run(
+		input,
+		blackfriday.WithRenderer(renderer),
+		blackfriday.WithExtensions(Extensions()),
+	)
+
+	if _, err := os.Stdout.Write(output); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,265 @@
+/*
+ * Copyright (c) 2015-2021 Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/russross/blackfriday/v2"
+)
+
+// orgDoc renders a document as Emacs Org-mode: "* Heading" stars,
+// "#+BEGIN_SRC"/"#+END_SRC" code blocks and "[[link][text]]" links. It
+// follows the same mark-and-truncate pattern as vimDoc for nodes whose
+// output depends on their fully rendered children (list items, links).
+type orgDoc struct {
+	filename string
+	desc     string
+	cols     int
+	tabs     int
+	flags    int
+
+	buf       bytes.Buffer
+	itemMark  []int
+	quoteMark []int
+	linkMark  []int
+	lists     []*list
+}
+
+func OrgDocRenderer(filename, desc string, cols, tabs, flags int) Renderer {
+	return &orgDoc{
+		filename: filename,
+		desc:     desc,
+		cols:     cols,
+		tabs:     tabs,
+		flags:    flags,
+	}
+}
+
+func (o *orgDoc) RenderNode(w io.Writer, node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+	switch node.Type {
+	case blackfriday.CodeBlock:
+		o.buf.WriteString("#+BEGIN_SRC")
+		if len(node.Info) > 0 {
+			o.buf.WriteString(" ")
+			o.buf.Write(node.Info)
+		}
+		o.buf.WriteString("\n")
+		o.buf.Write(node.Literal)
+		o.buf.WriteString("#+END_SRC\n\n")
+
+	case blackfriday.BlockQuote:
+		if entering {
+			o.quoteMark = pushMark(o.quoteMark, o.buf.Len())
+		} else {
+			var mark int
+			o.quoteMark, mark = popMark(o.quoteMark)
+			text := strings.TrimRight(o.buf.String()[mark:], "\n")
+			o.buf.Truncate(mark)
+
+			o.buf.WriteString("#+BEGIN_QUOTE\n")
+			o.buf.WriteString(text)
+			o.buf.WriteString("\n#+END_QUOTE\n\n")
+		}
+
+	case blackfriday.HTMLBlock:
+		if entering {
+			o.buf.WriteString("#+BEGIN_EXPORT html\n")
+			o.buf.Write(node.Literal)
+			o.buf.WriteString("#+END_EXPORT\n\n")
+		}
+
+	case blackfriday.Heading:
+		if entering {
+			o.buf.WriteString(strings.Repeat("*", node.Level))
+			o.buf.WriteString(" ")
+		} else {
+			o.buf.WriteString("\n\n")
+		}
+
+	case blackfriday.HorizontalRule:
+		if entering {
+			o.buf.WriteString("-----\n\n")
+		}
+
+	case blackfriday.List:
+		if entering {
+			if node.IsFootnotesList {
+				o.writeFootnotes(node)
+				return blackfriday.SkipChildren
+			}
+			o.lists = append(o.lists, &list{1})
+		} else {
+			o.lists = o.lists[:len(o.lists)-1]
+			o.buf.WriteString("\n")
+		}
+
+	case blackfriday.Item:
+		if entering {
+			o.itemMark = pushMark(o.itemMark, o.buf.Len())
+		} else {
+			var mark int
+			o.itemMark, mark = popMark(o.itemMark)
+			text := o.buf.String()[mark:]
+			o.buf.Truncate(mark)
+
+			curr := o.lists[len(o.lists)-1]
+			marker := "- "
+			if node.ListFlags&blackfriday.ListTypeOrdered == blackfriday.ListTypeOrdered {
+				marker = fmt.Sprintf("%d. ", curr.index)
+				curr.index++
+			}
+
+			o.buf.WriteString(marker)
+			writeIndent(&o.buf, len(marker), text, len(marker))
+		}
+
+	case blackfriday.Paragraph:
+		if !entering {
+			o.buf.WriteString("\n\n")
+		}
+
+	case blackfriday.Table:
+		if entering {
+			o.writeTable(node)
+			return blackfriday.SkipChildren
+		}
+
+	case blackfriday.Emph:
+		o.buf.WriteString("/")
+
+	case blackfriday.Strong:
+		o.buf.WriteString("*")
+
+	case blackfriday.Del:
+		o.buf.WriteString("+")
+
+	case blackfriday.Image:
+		if entering {
+			return blackfriday.SkipChildren
+		}
+
+	case blackfriday.Link:
+		if entering {
+			if node.NoteID != 0 {
+				o.buf.WriteString(fmt.Sprintf("[fn:%s]", footnoteRefName(node)))
+				return blackfriday.SkipChildren
+			}
+			o.linkMark = pushMark(o.linkMark, o.buf.Len())
+		} else {
+			var mark int
+			o.linkMark, mark = popMark(o.linkMark)
+			text := o.buf.String()[mark:]
+			o.buf.Truncate(mark)
+
+			o.buf.WriteString(fmt.Sprintf("[[%s][%s]]", node.LinkData.Destination, text))
+		}
+
+	case blackfriday.Code:
+		o.buf.WriteString("=")
+		o.buf.Write(node.Literal)
+		o.buf.WriteString("=")
+
+	case blackfriday.HTMLSpan:
+		if entering {
+			o.buf.Write(node.Literal)
+		}
+
+	case blackfriday.Softbreak:
+		o.buf.WriteString(" ")
+
+	case blackfriday.Hardbreak:
+		o.buf.WriteString("\n")
+
+	case blackfriday.Text:
+		o.buf.Write(node.Literal)
+	}
+
+	return blackfriday.GoToNext
+}
+
+// writeTable reuses the same pipe-table layout as vimDoc, but with
+// orgSeparator set so the header rule comes out as Org's own `|---+---|`
+// row instead of a plain `+---+---+` one.
+func (o *orgDoc) writeTable(node *blackfriday.Node) {
+	header, aligns, rows := collectTable(node, func(cell *blackfriday.Node) string {
+		mark := o.buf.Len()
+		cell.Walk(func(n *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+			if n == cell {
+				return blackfriday.GoToNext
+			}
+			return o.RenderNode(nil, n, entering)
+		})
+		text := o.buf.String()[mark:]
+		o.buf.Truncate(mark)
+		return strings.TrimSpace(text)
+	})
+
+	if len(header) == 0 {
+		return
+	}
+
+	maxWidth := (o.cols - (len(header)*3 + 1)) / len(header)
+	o.buf.WriteString(formatTable(header, aligns, rows, maxWidth, true))
+	o.buf.WriteString("\n")
+}
+
+// writeFootnotes renders the trailing footnote-definition list as Org-mode's
+// own "[fn:name] text" definitions, which its inline [fn:name] references
+// above resolve against.
+func (o *orgDoc) writeFootnotes(node *blackfriday.Node) {
+	if node.FirstChild == nil {
+		return
+	}
+
+	for index, item := 1, node.FirstChild; item != nil; index, item = index+1, item.Next {
+		name := footnoteItemName(index, item)
+
+		mark := o.buf.Len()
+		item.Walk(func(n *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+			if n == item {
+				return blackfriday.GoToNext
+			}
+			return o.RenderNode(nil, n, entering)
+		})
+		text := strings.TrimSpace(o.buf.String()[mark:])
+		o.buf.Truncate(mark)
+
+		o.buf.WriteString(fmt.Sprintf("[fn:%s] %s\n", name, text))
+	}
+	o.buf.WriteString("\n")
+}
+
+func (o *orgDoc) RenderHeader(w io.Writer, ast *blackfriday.Node) {
+	o.buf.WriteString(fmt.Sprintf("#+TITLE: %s\n", o.filename))
+	if len(o.desc) > 0 {
+		o.buf.WriteString(fmt.Sprintf("#+SUBTITLE: %s\n", o.desc))
+	}
+	o.buf.WriteString("\n")
+}
+
+func (o *orgDoc) RenderFooter(w io.Writer, ast *blackfriday.Node) {
+	w.Write(o.buf.Bytes())
+}
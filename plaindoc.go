@@ -0,0 +1,285 @@
+/*
+ * Copyright (c) 2015-2021 Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/russross/blackfriday/v2"
+)
+
+// plainDoc renders a document as wrapped plain text: underlined headings,
+// numbered chapters (reusing the same chapterNumber helper vimDoc's TOC
+// uses) and no markup at all for emphasis or links.
+type plainDoc struct {
+	filename string
+	desc     string
+	cols     int
+	tabs     int
+	flags    int
+	headings []*heading
+
+	buf         bytes.Buffer
+	headingMark []int
+	itemMark    []int
+	linkMark    []int
+	paraMark    []int
+	quoteMark   []int
+	lists       []*list
+}
+
+func PlainDocRenderer(filename, desc string, cols, tabs, flags int) Renderer {
+	return &plainDoc{
+		filename: filename,
+		desc:     desc,
+		cols:     cols,
+		tabs:     tabs,
+		flags:    flags,
+	}
+}
+
+func (p *plainDoc) RenderNode(w io.Writer, node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+	switch node.Type {
+	case blackfriday.CodeBlock:
+		writeIndent(&p.buf, p.tabs, string(node.Literal), 0)
+		p.buf.WriteString("\n")
+
+	case blackfriday.BlockQuote:
+		if entering {
+			p.quoteMark = pushMark(p.quoteMark, p.buf.Len())
+		} else {
+			var mark int
+			p.quoteMark, mark = popMark(p.quoteMark)
+			text := string(p.buf.Bytes()[mark:])
+			p.buf.Truncate(mark)
+
+			writeIndent(&p.buf, p.tabs, text, 0)
+			p.buf.WriteString("\n")
+		}
+
+	case blackfriday.HTMLBlock:
+		if entering {
+			writeIndent(&p.buf, p.tabs, string(node.Literal), 0)
+			p.buf.WriteString("\n")
+		}
+
+	case blackfriday.Heading:
+		if entering {
+			p.headingMark = pushMark(p.headingMark, p.buf.Len())
+		} else {
+			var mark int
+			p.headingMark, mark = popMark(p.headingMark)
+			text := append([]byte{}, p.buf.Bytes()[mark:]...)
+			p.buf.Truncate(mark)
+
+			h := &heading{text, node.Level}
+			p.headings = append(p.headings, h)
+
+			title := fmt.Sprintf("%s %s", chapterNumber(p.headings, h), text)
+			p.buf.WriteString(title)
+			p.buf.WriteString("\n")
+			if p.flags&flagNoRules == 0 {
+				rule := "-"
+				if node.Level == 1 {
+					rule = "="
+				}
+				p.buf.WriteString(strings.Repeat(rule, runeLen(title)))
+			}
+			p.buf.WriteString("\n\n")
+		}
+
+	case blackfriday.HorizontalRule:
+		if entering {
+			writeRule(&p.buf, p.cols, "-")
+		}
+
+	case blackfriday.List:
+		if entering {
+			if node.IsFootnotesList {
+				p.writeFootnotes(node)
+				return blackfriday.SkipChildren
+			}
+			p.lists = append(p.lists, &list{1})
+		} else {
+			p.lists = p.lists[:len(p.lists)-1]
+		}
+
+	case blackfriday.Item:
+		if entering {
+			p.itemMark = pushMark(p.itemMark, p.buf.Len())
+		} else {
+			var mark int
+			p.itemMark, mark = popMark(p.itemMark)
+			text := p.buf.String()[mark:]
+			p.buf.Truncate(mark)
+
+			curr := p.lists[len(p.lists)-1]
+			marker := "* "
+			if node.ListFlags&blackfriday.ListTypeOrdered == blackfriday.ListTypeOrdered {
+				marker = fmt.Sprintf("%d. ", curr.index)
+				curr.index++
+			}
+
+			p.buf.WriteString(marker)
+			writeIndent(&p.buf, len(marker), text, len(marker))
+		}
+
+	case blackfriday.Paragraph:
+		if entering {
+			p.paraMark = pushMark(p.paraMark, p.buf.Len())
+		} else {
+			var mark int
+			p.paraMark, mark = popMark(p.paraMark)
+			text := strings.TrimSpace(p.buf.String()[mark:])
+			p.buf.Truncate(mark)
+
+			p.writeWrapped(text)
+		}
+
+	case blackfriday.Table:
+		if entering {
+			p.writeTable(node)
+			return blackfriday.SkipChildren
+		}
+
+	case blackfriday.Image:
+		if entering {
+			return blackfriday.SkipChildren
+		}
+
+	case blackfriday.Link:
+		if entering {
+			if node.NoteID != 0 {
+				p.buf.WriteString(fmt.Sprintf("[%s]", footnoteRefName(node)))
+				return blackfriday.SkipChildren
+			}
+			p.linkMark = pushMark(p.linkMark, p.buf.Len())
+		} else {
+			var mark int
+			p.linkMark, mark = popMark(p.linkMark)
+			text := p.buf.String()[mark:]
+			p.buf.Truncate(mark)
+
+			p.buf.WriteString(fmt.Sprintf("%s (%s)", text, node.LinkData.Destination))
+		}
+
+	case blackfriday.Code:
+		p.buf.Write(node.Literal)
+
+	case blackfriday.Softbreak:
+		p.buf.WriteString(" ")
+
+	case blackfriday.Hardbreak:
+		p.buf.WriteString("\n")
+
+	case blackfriday.Text:
+		p.buf.Write(node.Literal)
+	}
+
+	return blackfriday.GoToNext
+}
+
+// writeWrapped appends text to p.buf word-wrapped to p.cols-p.tabs columns.
+func (p *plainDoc) writeWrapped(text string) {
+	for _, line := range wrapWords(text, p.cols-p.tabs) {
+		p.buf.WriteString(line)
+		p.buf.WriteString("\n")
+	}
+	p.buf.WriteString("\n")
+}
+
+// writeFootnotes renders the trailing footnote-definition list as its own
+// "Footnotes" heading (picked up by the chapter numbering like any other
+// heading) followed by each entry's wrapped "[name] text", matching the
+// "[name]" inline references written above by the Link case.
+func (p *plainDoc) writeFootnotes(node *blackfriday.Node) {
+	if node.FirstChild == nil {
+		return
+	}
+
+	title := []byte("Footnotes")
+	h := &heading{title, 1}
+	p.headings = append(p.headings, h)
+
+	line := fmt.Sprintf("%s %s", chapterNumber(p.headings, h), title)
+	p.buf.WriteString(line)
+	p.buf.WriteString("\n")
+	if p.flags&flagNoRules == 0 {
+		p.buf.WriteString(strings.Repeat("=", runeLen(line)))
+	}
+	p.buf.WriteString("\n\n")
+
+	for index, item := 1, node.FirstChild; item != nil; index, item = index+1, item.Next {
+		name := footnoteItemName(index, item)
+
+		mark := p.buf.Len()
+		item.Walk(func(n *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+			if n == item {
+				return blackfriday.GoToNext
+			}
+			return p.RenderNode(nil, n, entering)
+		})
+		text := strings.TrimSpace(p.buf.String()[mark:])
+		p.buf.Truncate(mark)
+
+		p.writeWrapped(fmt.Sprintf("[%s] %s", name, text))
+	}
+}
+
+func (p *plainDoc) writeTable(node *blackfriday.Node) {
+	header, aligns, rows := collectTable(node, func(cell *blackfriday.Node) string {
+		mark := p.buf.Len()
+		cell.Walk(func(n *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+			if n == cell {
+				return blackfriday.GoToNext
+			}
+			return p.RenderNode(nil, n, entering)
+		})
+		text := p.buf.String()[mark:]
+		p.buf.Truncate(mark)
+		return strings.TrimSpace(text)
+	})
+
+	if len(header) == 0 {
+		return
+	}
+
+	maxWidth := (p.cols - (len(header)*3 + 1)) / len(header)
+	p.buf.WriteString(formatTable(header, aligns, rows, maxWidth, false))
+	p.buf.WriteString("\n")
+}
+
+func (p *plainDoc) RenderHeader(w io.Writer, ast *blackfriday.Node) {
+	if len(p.desc) > 0 {
+		p.buf.WriteString(fmt.Sprintf("%s - %s\n\n", p.filename, p.desc))
+	} else {
+		p.buf.WriteString(p.filename)
+		p.buf.WriteString("\n\n")
+	}
+}
+
+func (p *plainDoc) RenderFooter(w io.Writer, ast *blackfriday.Node) {
+	w.Write(p.buf.Bytes())
+}
@@ -0,0 +1,372 @@
+/*
+ * Copyright (c) 2015-2021 Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/russross/blackfriday/v2"
+)
+
+// Renderer is implemented by each output backend (vimhelp, org, plain text).
+// It is exactly blackfriday's own Renderer interface, named here so callers
+// picking a backend by -format don't need to spell out the blackfriday
+// package just to hold the result.
+type Renderer = blackfriday.Renderer
+
+// writeSplitText writes left and right padded out to cols+trim columns with
+// repeat characters filling the gap between them, e.g. "Heading ... *tag*".
+func writeSplitText(out *bytes.Buffer, cols int, left, right []byte, repeat string, trim int) {
+	padding := cols - (len(left) + len(right)) + trim
+	if padding <= 0 {
+		padding = 1
+	}
+
+	out.Write(left)
+	out.WriteString(strings.Repeat(repeat, padding))
+	out.Write(right)
+	out.WriteString("\n")
+}
+
+// writeRule writes a single full-width rule line.
+func writeRule(out *bytes.Buffer, cols int, repeat string) {
+	out.WriteString(strings.Repeat(repeat, cols))
+	out.WriteString("\n")
+}
+
+// writeIndent indents every non-empty line of text by tabs spaces, trimming
+// that indent by trim columns on the first line (e.g. to make room for a
+// list marker already written on that line) when trim does not exceed tabs.
+// Empty lines are dropped.
+func writeIndent(out *bytes.Buffer, tabs int, text string, trim int) {
+	lines := strings.Split(text, "\n")
+
+	for index, line := range lines {
+		width := tabs
+		if width >= trim && index == 0 {
+			width -= trim
+		}
+
+		if len(line) > 0 {
+			out.WriteString(strings.Repeat(" ", width))
+			out.WriteString(line)
+			out.WriteString("\n")
+		}
+	}
+}
+
+// chapterNumber builds the dotted chapter number (e.g. "2.1.") for h by
+// counting its preceding siblings at each heading level up to the document
+// root. Shared by any backend that numbers its headings.
+func chapterNumber(headings []*heading, h *heading) []byte {
+	index := -1
+	for i, curr := range headings {
+		if curr == h {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		log.Fatal("heading not found")
+	}
+
+	var chapters []int
+	level := h.level
+	siblings := 1
+
+	for i := index - 1; i >= 0; i-- {
+		curr := headings[i]
+		if curr.level == level {
+			siblings++
+		} else if curr.level < level {
+			chapters = append(chapters, siblings)
+			level = curr.level
+			siblings = 1
+		}
+	}
+	chapters = append(chapters, siblings)
+
+	var out bytes.Buffer
+	for i := len(chapters) - 1; i >= 0; i-- {
+		out.WriteString(strconv.Itoa(chapters[i]))
+		out.WriteString(".")
+	}
+
+	return out.Bytes()
+}
+
+// footnoteRefName returns the stable label for an inline footnote reference
+// (a Link node with NoteID != 0), preferring the definition's own reference
+// label and falling back to its positional note ID when blackfriday didn't
+// carry one over.
+func footnoteRefName(node *blackfriday.Node) string {
+	if node.Footnote != nil && len(node.Footnote.RefLink) > 0 {
+		return string(node.Footnote.RefLink)
+	}
+	return strconv.Itoa(node.NoteID)
+}
+
+// footnoteItemName returns the same label for the corresponding item in the
+// trailing footnote-definition list, given its 1-based position in it.
+func footnoteItemName(index int, item *blackfriday.Node) string {
+	if len(item.RefLink) > 0 {
+		return string(item.RefLink)
+	}
+	return strconv.Itoa(index)
+}
+
+// runeLen is len() for a string's rune count rather than its byte count, so
+// column math stays correct for multi-byte UTF-8 content.
+func runeLen(text string) int {
+	return len([]rune(text))
+}
+
+// wrapWords greedily wraps text into lines no wider than width, without
+// breaking individual words.
+func wrapWords(text string, width int) []string {
+	if text == "" {
+		return []string{""}
+	}
+
+	var lines []string
+	var line string
+
+	for _, word := range splitAtomicWords(text) {
+		if line == "" {
+			line = word
+		} else if runeLen(line)+1+runeLen(word) <= width {
+			line += " " + word
+		} else {
+			lines = append(lines, line)
+			line = word
+		}
+	}
+
+	if line != "" {
+		lines = append(lines, line)
+	}
+
+	if len(lines) == 0 {
+		lines = []string{""}
+	}
+
+	return lines
+}
+
+// wrapCell is wrapWords for table cells: it additionally hard-breaks any
+// line still wider than width (a single word longer than the column) so
+// every line formatTable emits actually fits, keeping cell borders aligned.
+// Prose wrapping (writeWrapped) deliberately never does this, since breaking
+// mid-word there would be far more visible than in a narrow table column.
+func wrapCell(text string, width int) []string {
+	var lines []string
+	for _, line := range wrapWords(text, width) {
+		for runeLen(line) > width {
+			r := []rune(line)
+			lines = append(lines, string(r[:width]))
+			line = string(r[width:])
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// splitAtomicWords tokenizes text on whitespace like strings.Fields, except
+// that a `code span` or |help-tag| is kept whole even if it contains spaces,
+// so wrapWords never breaks a line inside one.
+func splitAtomicWords(text string) []string {
+	var words []string
+	var word strings.Builder
+	var delim rune
+
+	flush := func() {
+		if word.Len() > 0 {
+			words = append(words, word.String())
+			word.Reset()
+		}
+	}
+
+	for _, r := range text {
+		switch {
+		case delim != 0:
+			word.WriteRune(r)
+			if r == delim {
+				delim = 0
+			}
+		case r == '`' || r == '|':
+			word.WriteRune(r)
+			delim = r
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			flush()
+		default:
+			word.WriteRune(r)
+		}
+	}
+	flush()
+
+	return words
+}
+
+func padCell(text string, width int, align blackfriday.CellAlignFlags) string {
+	diff := width - runeLen(text)
+	if diff < 0 {
+		diff = 0
+	}
+
+	switch align {
+	case blackfriday.TableAlignmentRight:
+		return strings.Repeat(" ", diff) + text
+	case blackfriday.TableAlignmentCenter:
+		left := diff / 2
+		return strings.Repeat(" ", left) + text + strings.Repeat(" ", diff-left)
+	default:
+		return text + strings.Repeat(" ", diff)
+	}
+}
+
+// formatTable lays out header/body cells into a pipe-delimited, column
+// aligned table, wrapping cell content to maxWidth per column. The
+// separator row under the header uses a plain `+---+---+` rule unless
+// orgSeparator is set, in which case it uses Org-mode's own `|---+---|`
+// pipe-edged rule instead, so the result parses as a native Org table.
+func formatTable(header []string, aligns []blackfriday.CellAlignFlags, rows [][]string, maxWidth int, orgSeparator bool) string {
+	if len(header) == 0 {
+		return ""
+	}
+
+	if maxWidth < 3 {
+		maxWidth = 3
+	}
+
+	widths := make([]int, len(header))
+	for i, cell := range header {
+		widths[i] = runeLen(cell)
+		if widths[i] > maxWidth {
+			widths[i] = maxWidth
+		}
+	}
+	for _, row := range rows {
+		for i, cell := range row {
+			if i >= len(widths) {
+				continue
+			}
+			if w := runeLen(cell); w > widths[i] {
+				widths[i] = w
+			}
+		}
+	}
+	for i := range widths {
+		if widths[i] > maxWidth {
+			widths[i] = maxWidth
+		}
+	}
+
+	var out bytes.Buffer
+	writeRow := func(cells []string) {
+		wrapped := make([][]string, len(widths))
+		height := 1
+		for i := range widths {
+			cell := ""
+			if i < len(cells) {
+				cell = cells[i]
+			}
+			wrapped[i] = wrapCell(cell, widths[i])
+			if len(wrapped[i]) > height {
+				height = len(wrapped[i])
+			}
+		}
+
+		for line := 0; line < height; line++ {
+			out.WriteString("|")
+			for i, w := range widths {
+				var piece string
+				if line < len(wrapped[i]) {
+					piece = wrapped[i][line]
+				}
+				align := blackfriday.CellAlignFlags(0)
+				if i < len(aligns) {
+					align = aligns[i]
+				}
+				out.WriteString(" ")
+				out.WriteString(padCell(piece, w, align))
+				out.WriteString(" |")
+			}
+			out.WriteString("\n")
+		}
+	}
+
+	writeSeparator := func() {
+		edge := "+"
+		if orgSeparator {
+			edge = "|"
+		}
+
+		parts := make([]string, len(widths))
+		for i, w := range widths {
+			parts[i] = strings.Repeat("-", w+2)
+		}
+
+		out.WriteString(edge)
+		out.WriteString(strings.Join(parts, "+"))
+		out.WriteString(edge)
+		out.WriteString("\n")
+	}
+
+	writeRow(header)
+	writeSeparator()
+	for _, row := range rows {
+		writeRow(row)
+	}
+
+	return out.String()
+}
+
+// collectTable walks a Table node's TableHead/TableBody sections, rendering
+// each cell's inline content through render (the owning backend's own
+// RenderNode dispatch) so emphasis, code spans and links inside cells come
+// out the same as everywhere else in the document.
+func collectTable(node *blackfriday.Node, render func(cell *blackfriday.Node) string) (header []string, aligns []blackfriday.CellAlignFlags, rows [][]string) {
+	for section := node.FirstChild; section != nil; section = section.Next {
+		switch section.Type {
+		case blackfriday.TableHead:
+			for row := section.FirstChild; row != nil; row = row.Next {
+				for cell := row.FirstChild; cell != nil; cell = cell.Next {
+					header = append(header, render(cell))
+					aligns = append(aligns, cell.Align)
+				}
+			}
+		case blackfriday.TableBody:
+			for row := section.FirstChild; row != nil; row = row.Next {
+				var cells []string
+				for cell := row.FirstChild; cell != nil; cell = cell.Next {
+					cells = append(cells, render(cell))
+				}
+				rows = append(rows, cells)
+			}
+		}
+	}
+
+	return header, aligns, rows
+}
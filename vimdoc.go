@@ -24,13 +24,12 @@ package main
 import (
 	"bytes"
 	"fmt"
-	"log"
+	"io"
 	"path"
 	"regexp"
-	"strconv"
 	"strings"
 
-	"github.com/russross/blackfriday"
+	"github.com/russross/blackfriday/v2"
 )
 
 const (
@@ -42,8 +41,20 @@ const (
 	flagNoToc = 1 << iota
 	flagNoRules
 	flagPascal
+	flagConceal
 )
 
+// Extensions returns the blackfriday v2 extensions this renderer expects the
+// parser to be configured with. Callers building the *blackfriday.Markdown
+// instance should pass this to blackfriday.WithExtensions.
+func Extensions() blackfriday.Extensions {
+	return blackfriday.Tables |
+		blackfriday.Strikethrough |
+		blackfriday.Footnotes |
+		blackfriday.AutoHeadingIDs |
+		blackfriday.DefinitionLists
+}
+
 type list struct {
 	index int
 }
@@ -63,9 +74,16 @@ type vimDoc struct {
 	tocPos   int
 	lists    []*list
 	headings []*heading
+
+	buf         bytes.Buffer
+	headingMark []int
+	quoteMark   []int
+	itemMark    []int
+	linkMark    []int
+	paraMark    []int
 }
 
-func VimDocRenderer(filename, desc string, cols, tabs, flags int) blackfriday.Renderer {
+func VimDocRenderer(filename, desc string, cols, tabs, flags int) Renderer {
 	filename = path.Base(filename)
 	title := filename
 
@@ -104,64 +122,15 @@ func (v *vimDoc) buildHelpTag(text []byte) []byte {
 }
 
 func (v *vimDoc) buildChapters(h *heading) []byte {
-	index := -1
-	{
-		for i, curr := range v.headings {
-			if curr == h {
-				index = i
-				break
-			}
-		}
-
-		if index < 0 {
-			log.Fatal("heading not found")
-		}
-	}
-
-	var chapters []int
-	{
-		level := h.level
-		siblings := 1
-
-		for i := index - 1; i >= 0; i-- {
-			curr := v.headings[i]
-
-			if curr.level == level {
-				siblings++
-			} else if curr.level < level {
-				chapters = append(chapters, siblings)
-				level = curr.level
-				siblings = 1
-			}
-		}
-
-		chapters = append(chapters, siblings)
-	}
-
-	var out bytes.Buffer
-	for i := len(chapters) - 1; i >= 0; i-- {
-		out.WriteString(strconv.Itoa(chapters[i]))
-		out.WriteString(".")
-	}
-
-	return out.Bytes()
+	return chapterNumber(v.headings, h)
 }
 
 func (v *vimDoc) writeSplitText(out *bytes.Buffer, left, right []byte, repeat string, trim int) {
-	padding := v.cols - (len(left) + len(right)) + trim
-	if padding <= 0 {
-		padding = 1
-	}
-
-	out.Write(left)
-	out.WriteString(strings.Repeat(repeat, padding))
-	out.Write(right)
-	out.WriteString("\n")
+	writeSplitText(out, v.cols, left, right, repeat, trim)
 }
 
 func (v *vimDoc) writeRule(out *bytes.Buffer, repeat string) {
-	out.WriteString(strings.Repeat(repeat, v.cols))
-	out.WriteString("\n")
+	writeRule(out, v.cols, repeat)
 }
 
 func (v *vimDoc) writeToc(out *bytes.Buffer) {
@@ -173,221 +142,362 @@ func (v *vimDoc) writeToc(out *bytes.Buffer) {
 }
 
 func (v *vimDoc) writeIndent(out *bytes.Buffer, text string, trim int) {
-	lines := strings.Split(text, "\n")
+	writeIndent(out, v.tabs, text, trim)
+}
 
-	for index, line := range lines {
-		width := v.tabs
-		if width >= trim && index == 0 {
-			width -= trim
+// hasBlockChild reports whether node has a direct child of type t, used to
+// tell a "tight" list item (plain inline content that still needs wrapping)
+// apart from a "loose" one (a Paragraph or nested List that has already been
+// wrapped/indented by its own node handler).
+func hasBlockChild(node *blackfriday.Node, t blackfriday.NodeType) bool {
+	for c := node.FirstChild; c != nil; c = c.Next {
+		if c.Type == t {
+			return true
 		}
+	}
+	return false
+}
+
+// writeWrapped word-wraps text to the current cols budget (narrowed by any
+// open list nesting, since each enclosing list item indents it again on the
+// way out) and appends it to v.buf as a paragraph, one blank line after.
+// Hard line breaks are preserved by wrapping each of their segments on its
+// own rather than letting them reflow into one another.
+func (v *vimDoc) writeWrapped(text string) {
+	width := v.cols - len(v.lists)*v.tabs
+	if width < 1 {
+		width = 1
+	}
 
-		if len(line) > 0 {
-			out.WriteString(strings.Repeat(" ", width))
-			out.WriteString(line)
-			out.WriteString("\n")
+	for _, segment := range strings.Split(text, "\n") {
+		for _, line := range wrapWords(segment, width) {
+			v.buf.WriteString(line)
+			v.buf.WriteString("\n")
 		}
 	}
+	v.buf.WriteString("\n")
 }
 
-// Block-level callbacks
-func (v *vimDoc) BlockCode(out *bytes.Buffer, text []byte, lang string) {
-	out.WriteString(">\n")
-	v.writeIndent(out, string(text), 0)
-	out.WriteString("<\n\n")
-}
-
-func (v *vimDoc) BlockQuote(out *bytes.Buffer, text []byte) {
-	out.WriteString(">\n")
-	v.writeIndent(out, string(text), 0)
-	out.WriteString("<\n\n")
-}
-
-func (v *vimDoc) BlockHtml(out *bytes.Buffer, text []byte) {
-	out.WriteString(">\n")
-	v.writeIndent(out, string(text), 0)
-	out.WriteString("<\n\n")
-}
-
-func (v *vimDoc) Header(out *bytes.Buffer, text func() bool, level int, id string) {
-	initPos := out.Len()
-	if v.flags&flagNoRules == 0 {
-		switch level {
-		case 1:
-			v.writeRule(out, "=")
-		case 2:
-			v.writeRule(out, "-")
+// tableCellText renders a table cell's inline content (text, emphasis, code,
+// links, ...) through the normal node dispatch, the same mark-and-truncate
+// trick used for list items and links, and returns it as a plain string.
+func (v *vimDoc) tableCellText(cell *blackfriday.Node) string {
+	mark := v.buf.Len()
+	cell.Walk(func(n *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+		if n == cell {
+			return blackfriday.GoToNext
 		}
-	}
-
-	headingPos := out.Len()
-	if !text() {
-		out.Truncate(initPos)
+		return v.RenderNode(nil, n, entering)
+	})
+	text := v.buf.String()[mark:]
+	v.buf.Truncate(mark)
+	return strings.TrimSpace(text)
+}
+
+// writeTable collects a GFM table's header/body cells and alignment flags
+// and writes the result, wrapped in a `>` ... `<` code block, as a
+// fixed-width aligned table sized to the v.cols budget.
+func (v *vimDoc) writeTable(node *blackfriday.Node) {
+	header, aligns, rows := collectTable(node, v.tableCellText)
+	if len(header) == 0 {
 		return
 	}
 
-	var temp []byte
-	temp = append(temp, out.Bytes()[headingPos:]...)
-	out.Truncate(headingPos)
-
-	h := &heading{temp, level}
-	v.headings = append(v.headings, h)
-
-	tag := fmt.Sprintf("*%s*", v.buildHelpTag(h.text))
-	v.writeSplitText(out, bytes.ToUpper(h.text), []byte(tag), " ", 2)
-	out.WriteString("\n")
-}
+	maxWidth := (v.cols - v.tabs - (len(header)*3 + 1)) / len(header)
+	table := formatTable(header, aligns, rows, maxWidth, false)
 
-func (v *vimDoc) HRule(out *bytes.Buffer) {
-	v.writeRule(out, "-")
+	v.buf.WriteString(">\n")
+	v.writeIndent(&v.buf, table, 0)
+	v.buf.WriteString("<\n\n")
 }
 
-func (v *vimDoc) List(out *bytes.Buffer, text func() bool, flags int) {
-	v.lists = append(v.lists, &list{1})
-	text()
-	v.lists = v.lists[:len(v.lists)-1]
+// footnoteName returns the stable label used to build a footnote's help tag,
+// preferring the definition's own reference label and falling back to its
+// positional note ID when blackfriday didn't carry one over.
+func (v *vimDoc) footnoteName(node *blackfriday.Node) string {
+	return footnoteRefName(node)
 }
 
-func (v *vimDoc) ListItem(out *bytes.Buffer, text []byte, flags int) {
-	marker := out.Len()
+// writeFootnotes renders the trailing footnote-definition list blackfriday
+// appends to the document as a "Footnotes" chapter, registering it as a
+// heading so it is picked up by writeToc, and anchors each item with the
+// same help tag its inline |...-fn-name| references point at. A footnote
+// item's body is a bare Text node rather than a Paragraph, so it never goes
+// through the Paragraph case's own wrapping; wrap it here instead, the same
+// way plainDoc.writeFootnotes wraps its entries.
+func (v *vimDoc) writeFootnotes(node *blackfriday.Node) {
+	if node.FirstChild == nil {
+		return
+	}
 
-	list := v.lists[len(v.lists)-1]
-	if flags&blackfriday.LIST_TYPE_ORDERED == blackfriday.LIST_TYPE_ORDERED {
-		out.WriteString(fmt.Sprintf("%d. ", list.index))
-		list.index++
-	} else {
-		out.WriteString("* ")
+	if v.flags&flagNoRules == 0 {
+		v.writeRule(&v.buf, "=")
 	}
 
-	v.writeIndent(out, string(text), out.Len()-marker)
+	title := []byte("Footnotes")
+	v.headings = append(v.headings, &heading{title, 1})
+
+	tag := fmt.Sprintf("*%s*", v.buildHelpTag(title))
+	v.writeSplitText(&v.buf, bytes.ToUpper(title), []byte(tag), " ", 2)
+	v.buf.WriteString("\n")
+
+	for index, item := 1, node.FirstChild; item != nil; index, item = index+1, item.Next {
+		name := footnoteItemName(index, item)
 
-	if flags&blackfriday.LIST_ITEM_END_OF_LIST != 0 {
-		out.WriteString("\n")
+		mark := v.buf.Len()
+		item.Walk(func(n *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+			if n == item {
+				return blackfriday.GoToNext
+			}
+			return v.RenderNode(nil, n, entering)
+		})
+		text := strings.TrimSpace(v.buf.String()[mark:])
+		v.buf.Truncate(mark)
+
+		itemTag := fmt.Sprintf("*%s*", v.buildHelpTag([]byte(fmt.Sprintf("fn-%s", name))))
+		v.buf.WriteString(itemTag)
+		v.buf.WriteString("\n")
+		wrapped := strings.Join(wrapWords(text, v.cols-v.tabs), "\n")
+		v.writeIndent(&v.buf, wrapped, 0)
+		v.buf.WriteString("\n")
 	}
 }
 
-func (*vimDoc) Paragraph(out *bytes.Buffer, text func() bool) {
-	marker := out.Len()
+// pushMark/popMark maintain the small per-node-type position stacks used to
+// capture a subtree's rendered output (written to v.buf while its children
+// are walked) so it can be post-processed once the node is left, mirroring
+// the way the old blackfriday v1 callbacks received fully rendered text.
+func pushMark(marks []int, pos int) []int {
+	return append(marks, pos)
+}
+
+func popMark(marks []int) ([]int, int) {
+	last := len(marks) - 1
+	return marks[:last], marks[last]
+}
+
+// RenderNode is called for every node in the AST, once when entering it and,
+// for container nodes (unless SkipChildren/Terminate is returned), once again
+// when leaving it; leaf nodes such as Text, Code and CodeBlock are visited
+// only once. It replaces the per-element blackfriday v1 callbacks, splitting
+// each element's handling across the entering and leaving events instead of
+// receiving pre-rendered child text as an argument.
+func (v *vimDoc) RenderNode(w io.Writer, node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+	switch node.Type {
+	case blackfriday.CodeBlock:
+		v.buf.WriteString(">\n")
+		v.writeIndent(&v.buf, string(node.Literal), 0)
+		v.buf.WriteString("<\n\n")
+
+	case blackfriday.BlockQuote:
+		if entering {
+			v.quoteMark = pushMark(v.quoteMark, v.buf.Len())
+		} else {
+			var mark int
+			v.quoteMark, mark = popMark(v.quoteMark)
+			text := string(v.buf.Bytes()[mark:])
+			v.buf.Truncate(mark)
+
+			v.buf.WriteString(">\n")
+			v.writeIndent(&v.buf, text, 0)
+			v.buf.WriteString("<\n\n")
+		}
 
-	if !text() {
-		out.Truncate(marker)
-		return
-	}
+	case blackfriday.HTMLBlock:
+		if entering {
+			v.buf.WriteString(">\n")
+			v.writeIndent(&v.buf, string(node.Literal), 0)
+			v.buf.WriteString("<\n\n")
+		}
 
-	out.WriteString("\n\n")
-}
+	case blackfriday.Heading:
+		if entering {
+			if v.flags&flagNoRules == 0 {
+				switch node.Level {
+				case 1:
+					v.writeRule(&v.buf, "=")
+				case 2:
+					v.writeRule(&v.buf, "-")
+				}
+			}
+			v.headingMark = pushMark(v.headingMark, v.buf.Len())
+		} else {
+			var mark int
+			v.headingMark, mark = popMark(v.headingMark)
+			text := append([]byte{}, v.buf.Bytes()[mark:]...)
+			v.buf.Truncate(mark)
+
+			h := &heading{text, node.Level}
+			v.headings = append(v.headings, h)
+
+			tag := fmt.Sprintf("*%s*", v.buildHelpTag(h.text))
+			v.writeSplitText(&v.buf, bytes.ToUpper(h.text), []byte(tag), " ", 2)
+			v.buf.WriteString("\n")
+		}
 
-func (*vimDoc) Table(out *bytes.Buffer, heading []byte, body []byte, columnData []int) {
-	// unimplemented
-	log.Println("Table is unimplemented")
-}
+	case blackfriday.HorizontalRule:
+		if entering {
+			v.writeRule(&v.buf, "-")
+		}
 
-func (*vimDoc) TableRow(out *bytes.Buffer, text []byte) {
-	// unimplemented
-	log.Println("TableRow is unimplemented")
-}
+	case blackfriday.List:
+		if entering {
+			if node.IsFootnotesList {
+				v.writeFootnotes(node)
+				return blackfriday.SkipChildren
+			}
+			v.lists = append(v.lists, &list{1})
+		} else {
+			v.lists = v.lists[:len(v.lists)-1]
+		}
 
-func (*vimDoc) TableHeaderCell(out *bytes.Buffer, text []byte, flags int) {
-	// unimplemented
-	log.Println("TableHeaderCell is unimplemented")
-}
+	case blackfriday.Item:
+		if entering {
+			v.itemMark = pushMark(v.itemMark, v.buf.Len())
+		} else {
+			var mark int
+			v.itemMark, mark = popMark(v.itemMark)
+			text := v.buf.String()[mark:]
+			v.buf.Truncate(mark)
+
+			if !hasBlockChild(node, blackfriday.Paragraph) && !hasBlockChild(node, blackfriday.List) {
+				width := v.cols - len(v.lists)*v.tabs
+				text = strings.Join(wrapWords(strings.TrimSpace(text), width), "\n")
+			}
 
-func (*vimDoc) TableCell(out *bytes.Buffer, text []byte, flags int) {
-	// unimplemented
-	log.Println("TableCell is unimplemented")
-}
+			list := v.lists[len(v.lists)-1]
+			markerStart := v.buf.Len()
+			if node.ListFlags&blackfriday.ListTypeOrdered == blackfriday.ListTypeOrdered {
+				v.buf.WriteString(fmt.Sprintf("%d. ", list.index))
+				list.index++
+			} else {
+				v.buf.WriteString("* ")
+			}
 
-func (*vimDoc) Footnotes(out *bytes.Buffer, text func() bool) {
-	// unimplemented
-	log.Println("Footnotes is unimplemented")
-}
+			v.writeIndent(&v.buf, text, v.buf.Len()-markerStart)
 
-func (*vimDoc) FootnoteItem(out *bytes.Buffer, name, text []byte, flags int) {
-	// unimplemented
-	log.Println("FootnoteItem is unimplemented")
-}
+			if node.Next == nil {
+				v.buf.WriteString("\n")
+			}
+		}
 
-func (*vimDoc) TitleBlock(out *bytes.Buffer, text []byte) {
-	// unimplemented
-	log.Println("TitleBlock is unimplemented")
-}
+	case blackfriday.Paragraph:
+		if entering {
+			v.paraMark = pushMark(v.paraMark, v.buf.Len())
+		} else {
+			var mark int
+			v.paraMark, mark = popMark(v.paraMark)
+			text := v.buf.String()[mark:]
+			v.buf.Truncate(mark)
 
-// Span-level callbacks
-func (*vimDoc) AutoLink(out *bytes.Buffer, link []byte, kind int) {
-	out.Write(link)
-}
+			v.writeWrapped(text)
+		}
 
-func (*vimDoc) CodeSpan(out *bytes.Buffer, text []byte) {
-	out.WriteString("`")
-	out.Write(text)
-	out.WriteString("`")
-}
+	case blackfriday.Table:
+		if entering {
+			v.writeTable(node)
+			return blackfriday.SkipChildren
+		}
 
-func (*vimDoc) DoubleEmphasis(out *bytes.Buffer, text []byte) {
-	out.Write(text)
-}
+	case blackfriday.Emph:
+		if v.flags&flagConceal != 0 {
+			v.buf.WriteString("*")
+		}
 
-func (*vimDoc) Emphasis(out *bytes.Buffer, text []byte) {
-	out.Write(text)
-}
+	case blackfriday.Strong:
+		if v.flags&flagConceal != 0 {
+			v.buf.WriteString("**")
+		}
 
-func (*vimDoc) Image(out *bytes.Buffer, link []byte, title []byte, alt []byte) {
-	// cannot view images in vim
-}
+	case blackfriday.Image:
+		if entering {
+			// cannot view images in vim
+			return blackfriday.SkipChildren
+		}
 
-func (*vimDoc) LineBreak(out *bytes.Buffer) {
-	out.WriteString("\n")
-}
+	case blackfriday.Link:
+		if entering {
+			if node.NoteID != 0 {
+				tag := fmt.Sprintf("|%s|", v.buildHelpTag([]byte(fmt.Sprintf("fn-%s", v.footnoteName(node)))))
+				v.buf.WriteString(tag)
+				return blackfriday.SkipChildren
+			}
+			v.linkMark = pushMark(v.linkMark, v.buf.Len())
+		} else {
+			var mark int
+			v.linkMark, mark = popMark(v.linkMark)
+			content := v.buf.Bytes()[mark:]
+			text := append([]byte{}, content...)
+			v.buf.Truncate(mark)
+
+			if v.flags&flagConceal != 0 {
+				v.buf.WriteString(fmt.Sprintf("[%s](%s)", text, node.LinkData.Destination))
+			} else {
+				v.buf.WriteString(fmt.Sprintf("%s (%s)", text, node.LinkData.Destination))
+			}
+		}
 
-func (*vimDoc) Link(out *bytes.Buffer, link []byte, title []byte, content []byte) {
-	out.WriteString(fmt.Sprintf("%s (%s)", content, link))
-}
+	case blackfriday.Code:
+		v.buf.WriteString("`")
+		v.buf.Write(node.Literal)
+		v.buf.WriteString("`")
 
-func (*vimDoc) RawHtmlTag(out *bytes.Buffer, tag []byte) {
-	// unimplemented
-	log.Println("StrikeThrough is unimplemented")
-}
+	case blackfriday.HTMLSpan:
+		if entering {
+			v.buf.Write(node.Literal)
+		}
 
-func (*vimDoc) TripleEmphasis(out *bytes.Buffer, text []byte) {
-	out.Write(text)
-}
+	case blackfriday.Del:
+		if v.flags&flagConceal != 0 {
+			v.buf.WriteString("~~")
+		}
 
-func (*vimDoc) StrikeThrough(out *bytes.Buffer, text []byte) {
-	// unimplemented
-	log.Println("StrikeThrough is unimplemented")
-}
+	case blackfriday.Softbreak:
+		v.buf.WriteString(" ")
 
-func (*vimDoc) FootnoteRef(out *bytes.Buffer, ref []byte, id int) {
-	// unimplemented
-	log.Println("FootnoteRef is unimplemented")
-}
+	case blackfriday.Hardbreak:
+		v.buf.WriteString("\n")
 
-// Low-level callbacks
-func (v *vimDoc) Entity(out *bytes.Buffer, entity []byte) {
-	out.Write(entity)
-}
+	case blackfriday.Text:
+		v.buf.Write(node.Literal)
 
-func (v *vimDoc) NormalText(out *bytes.Buffer, text []byte) {
-	out.Write(text)
+	case blackfriday.Document:
+		// nothing to do, RenderHeader/RenderFooter own the wrapping
+	}
+
+	return blackfriday.GoToNext
 }
 
-// Header and footer
-func (v *vimDoc) DocumentHeader(out *bytes.Buffer) {
+// RenderHeader and RenderFooter replace the DocumentHeader/DocumentFooter
+// callbacks from blackfriday v1. All node visits above write into v.buf
+// rather than w; the accumulated buffer is only flushed to w here, once
+// the TOC has been stitched into place.
+func (v *vimDoc) RenderHeader(w io.Writer, ast *blackfriday.Node) {
 	if len(v.desc) > 0 {
-		v.writeSplitText(out, []byte(v.filename), []byte(v.desc), " ", 0)
+		v.writeSplitText(&v.buf, []byte(v.filename), []byte(v.desc), " ", 0)
 	} else {
-		out.WriteString(v.filename)
-		out.WriteString("\n")
+		v.buf.WriteString(v.filename)
+		v.buf.WriteString("\n")
+	}
+
+	if v.flags&flagConceal != 0 {
+		v.buf.WriteString("This help file uses Markdown-ish delimiters (**bold**, *italic*,\n")
+		v.buf.WriteString("~~strike~~, `code`, [text](url)) left in place for conceal syntax\n")
+		v.buf.WriteString("highlighting. Pair it with syntax/md2vim.vim and 'conceallevel=2'\n")
+		v.buf.WriteString("to hide the delimiters. Highlight groups: vimdocConcealBold,\n")
+		v.buf.WriteString("vimdocConcealItalic, vimdocConcealStrike, vimdocConcealCode,\n")
+		v.buf.WriteString("vimdocConcealLink, vimdocConcealMark.\n\n")
 	}
 
-	out.WriteString("\n")
-	v.tocPos = out.Len()
+	v.buf.WriteString("\n")
+	v.tocPos = v.buf.Len()
 }
 
-func (v *vimDoc) DocumentFooter(out *bytes.Buffer) {
+func (v *vimDoc) RenderFooter(w io.Writer, ast *blackfriday.Node) {
 	var temp bytes.Buffer
 
 	if v.tocPos > 0 && v.flags&flagNoToc == 0 {
-		temp.Write(out.Bytes()[:v.tocPos])
+		temp.Write(v.buf.Bytes()[:v.tocPos])
 
 		v.writeRule(&temp, "=")
 		title := []byte("Contents")
@@ -397,15 +507,10 @@ func (v *vimDoc) DocumentFooter(out *bytes.Buffer) {
 		v.writeToc(&temp)
 		temp.WriteString("\n")
 
-		temp.Write(out.Bytes()[v.tocPos:])
+		temp.Write(v.buf.Bytes()[v.tocPos:])
 	} else {
-		temp.ReadFrom(out)
+		temp.Write(v.buf.Bytes())
 	}
 
-	out.Reset()
-	out.Write(v.fixupCodeTags(temp.Bytes()))
-}
-
-func (v *vimDoc) GetFlags() int {
-	return v.flags
+	w.Write(v.fixupCodeTags(temp.Bytes()))
 }